@@ -0,0 +1,89 @@
+package encodedstorage
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor wraps a chunk's bytes on the way to the erasure encoder, and
+// unwraps them on the way back out, so operators can trade CPU for disk
+// on cold data without changing the erasure parameters. The codec id
+// returned by ID is persisted per-chunk in StorageBlockEntry, so objects
+// written under different codecs (e.g. after a config change) still
+// decode correctly.
+type Compressor interface {
+	ID() string
+	Reader(io.Reader) (io.ReadCloser, error)
+	Writer(io.Writer) (io.WriteCloser, error)
+}
+
+// compressorForCodec resolves the codec id persisted in a StorageBlockEntry
+// back to the Compressor that can decode it, independent of whatever
+// Compressor the store is currently configured with.
+func compressorForCodec(codec string) (Compressor, error) {
+	switch codec {
+	case "", NoopCompressor{}.ID():
+		return NoopCompressor{}, nil
+	case GzipCompressor{}.ID():
+		return GzipCompressor{}, nil
+	case ZstdCompressor{}.ID():
+		return ZstdCompressor{}, nil
+	default:
+		return nil, fmt.Errorf("encodedstorage: unknown codec %q", codec)
+	}
+}
+
+// NoopCompressor passes chunk bytes through unchanged.
+type NoopCompressor struct{}
+
+func (NoopCompressor) ID() string { return "none" }
+
+func (NoopCompressor) Reader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+func (NoopCompressor) Writer(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// GzipCompressor compresses chunks with gzip.
+type GzipCompressor struct{}
+
+func (GzipCompressor) ID() string { return "gzip" }
+
+func (GzipCompressor) Reader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (GzipCompressor) Writer(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+// ZstdCompressor compresses chunks with zstd, which usually gives a
+// better ratio/speed tradeoff than gzip on the kind of cold data this is
+// meant for.
+type ZstdCompressor struct{}
+
+func (ZstdCompressor) ID() string { return "zstd" }
+
+func (ZstdCompressor) Reader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+func (ZstdCompressor) Writer(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
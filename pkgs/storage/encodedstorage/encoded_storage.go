@@ -2,13 +2,19 @@ package encodedstorage
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/minio-io/minio/pkgs/erasure"
 	"github.com/minio-io/minio/pkgs/split"
@@ -21,161 +27,688 @@ type encodedStorage struct {
 	K           int
 	M           int
 	BlockSize   uint64
-	objects     map[string]StorageEntry
+	Overwrite   bool
+	Compressor  Compressor
+	index       *MemoryIndex
+	logFile     *os.File
 	diskStorage []storage.ObjectStorage
+	ioPool      *ioPool
+	// mu guards blockRefs and logFile, both of which are read and written
+	// from whatever goroutine calls Put/Close/Abort/Collect/Checkpoint;
+	// an object store is expected to serve concurrent requests.
+	mu sync.Mutex
+	// blockRefs tracks which "diskIndex/hash" block shards are already
+	// present on disk, so identical shards written by later Puts can be
+	// skipped instead of re-stored.
+	blockRefs map[string]bool
+	// inFlightRefs counts, per "diskIndex/hash" block shard, how many
+	// still-open writers currently depend on it - whether they stored it
+	// themselves or skipped storing because it was already deduped.
+	// ShardReferenced alone only protects a shard once some writer's
+	// manifest has been committed to the index; a writer that dedup-
+	// matched an uncommitted shard from another in-flight writer needs
+	// this to keep an aborting writer from deleting it out from under
+	// the one still relying on it.
+	inFlightRefs map[string]int
 }
 
-func NewStorage(rootDir string, k, m int, blockSize uint64) (storage.ObjectStorage, error) {
+// StorageConfig configures NewStorage. Compressor may be left nil, in
+// which case chunks are stored uncompressed. IOConcurrency may be left
+// at zero, in which case every disk is allowed to be in flight at once.
+type StorageConfig struct {
+	RootDir       string
+	K             int
+	M             int
+	BlockSize     uint64
+	Overwrite     bool
+	Compressor    Compressor
+	IOConcurrency int
+}
+
+// ioPool bounds how many shard Put/Get calls may be in flight across all
+// disks at once, so a burst of large objects can't open unbounded
+// connections/file handles against a slow or remote backing store.
+type ioPool struct {
+	sem chan struct{}
+}
+
+func newIOPool(size int) *ioPool {
+	return &ioPool{sem: make(chan struct{}, size)}
+}
+
+func (p *ioPool) acquire() { p.sem <- struct{}{} }
+
+func (p *ioPool) release() { <-p.sem }
+
+func NewStorage(config StorageConfig) (storage.ObjectStorage, error) {
 	// create storage files
 	storageNodes := make([]storage.ObjectStorage, 16)
 	for i := 0; i < 16; i++ {
-		storageNode, err := appendstorage.NewStorage(rootDir, i)
+		storageNode, err := appendstorage.NewStorage(config.RootDir, i)
 		storageNodes[i] = storageNode
 		if err != nil {
 			return nil, err
 		}
 	}
-	objects := make(map[string]StorageEntry)
-	indexPath := path.Join(rootDir, "index")
-	if _, err := os.Stat(indexPath); err == nil {
-		indexFile, err := os.Open(indexPath)
-		defer indexFile.Close()
-		if err != nil {
-			return nil, err
-		}
-		encoder := gob.NewDecoder(indexFile)
-		err = encoder.Decode(&objects)
-		if err != nil {
-			return nil, err
-		}
+	index, logFile, err := loadIndex(config.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	compressor := config.Compressor
+	if compressor == nil {
+		compressor = NoopCompressor{}
+	}
+	ioConcurrency := config.IOConcurrency
+	if ioConcurrency <= 0 {
+		ioConcurrency = len(storageNodes)
 	}
 	newStorage := encodedStorage{
-		RootDir:     rootDir,
-		K:           k,
-		M:           m,
-		BlockSize:   blockSize,
-		objects:     objects,
-		diskStorage: storageNodes,
+		RootDir:      config.RootDir,
+		K:            config.K,
+		M:            config.M,
+		BlockSize:    config.BlockSize,
+		Overwrite:    config.Overwrite,
+		Compressor:   compressor,
+		index:        index,
+		logFile:      logFile,
+		diskStorage:  storageNodes,
+		ioPool:       newIOPool(ioConcurrency),
+		blockRefs:    make(map[string]bool),
+		inFlightRefs: make(map[string]int),
 	}
+	// block shards are content-addressed, so the ref set can be rebuilt
+	// from whatever node manifests were loaded from the index
+	newStorage.rebuildBlockRefs()
 	return &newStorage, nil
 }
 
+// ErrClosed is returned by ObjectReader and ObjectWriter operations once
+// the reader/writer has already been closed or aborted.
+var ErrClosed = errors.New("encodedstorage: use of closed object reader/writer")
+
+// ObjectReader streams the decoded bytes of an object out of the erasure
+// store. Read/Close behave like any io.ReadCloser, except that calling
+// either one again after Close returns ErrClosed.
+type ObjectReader interface {
+	io.ReadCloser
+}
+
+// ObjectWriter buffers writes into BlockSize chunks, erasure-encoding
+// each one as it fills, and finalizes the node manifest on Close. A
+// writer that will not be finished should be aborted with Abort rather
+// than left unclosed, so any shards it already stored are rolled back.
+type ObjectWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
 func (eStorage *encodedStorage) Get(objectPath string) (io.Reader, error) {
-	entry, ok := eStorage.objects[objectPath]
+	return eStorage.GetReader(objectPath)
+}
+
+// GetReader returns a streaming reader over the decoded bytes of
+// objectPath, or a nil ObjectReader if no such object exists.
+func (eStorage *encodedStorage) GetReader(objectPath string) (ObjectReader, error) {
+	entry, ok := eStorage.index.Get(objectPath)
 	if ok == false {
 		return nil, nil
 	}
 	reader, writer := io.Pipe()
 	go eStorage.readObject(objectPath, entry, writer)
-	return reader, nil
+	return &pipeObjectReader{PipeReader: reader}, nil
 }
 
+// List returns every object under listPath, satisfying storage.ObjectStorage.
+// For pagination and S3-style common-prefix rollups, use ListObjects.
 func (eStorage *encodedStorage) List(listPath string) ([]storage.ObjectDescription, error) {
-	return nil, errors.New("Not Implemented")
+	descriptions, _, err := eStorage.ListObjects(listPath, "", 0, "")
+	return descriptions, err
+}
+
+// ListObjects lists objects under prefix, resuming after marker (exclusive)
+// and returning at most maxKeys results (0 meaning unlimited). If
+// delimiter is set, keys sharing a common segment between prefix and the
+// next occurrence of delimiter are rolled up into a single description
+// for that common prefix, S3-style, instead of being listed individually.
+// truncated reports whether more results exist past maxKeys.
+func (eStorage *encodedStorage) ListObjects(prefix, marker string, maxKeys int, delimiter string) (descriptions []storage.ObjectDescription, truncated bool, err error) {
+	// without a delimiter, every match becomes exactly one description,
+	// so the index scan itself can be bounded to maxKeys; with a
+	// delimiter several matches can roll up into a single common-prefix
+	// description, so the scan is left unbounded and maxKeys is applied
+	// below instead, against the rolled-up result.
+	scanKeys := maxKeys
+	if delimiter != "" {
+		scanKeys = 0
+	}
+	matches, scanTruncated := eStorage.index.PathsWithPrefix(prefix, marker, scanKeys)
+	seenPrefixes := make(map[string]bool)
+	for _, objectPath := range matches {
+		if delimiter != "" {
+			rest := objectPath[len(prefix):]
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				commonPrefix := objectPath[:len(prefix)+i+len(delimiter)]
+				if seenPrefixes[commonPrefix] {
+					continue
+				}
+				if maxKeys > 0 && len(descriptions) >= maxKeys {
+					truncated = true
+					break
+				}
+				seenPrefixes[commonPrefix] = true
+				descriptions = append(descriptions, storage.ObjectDescription{Path: commonPrefix})
+				continue
+			}
+		}
+		if maxKeys > 0 && len(descriptions) >= maxKeys {
+			truncated = true
+			break
+		}
+		entry, ok := eStorage.index.Get(objectPath)
+		if !ok {
+			continue
+		}
+		descriptions = append(descriptions, storage.ObjectDescription{
+			Path:         objectPath,
+			Md5sum:       entry.Md5sum,
+			Size:         entry.Size,
+			LastModified: entry.LastModified,
+		})
+	}
+	if delimiter == "" {
+		truncated = scanTruncated
+	}
+	return descriptions, truncated, nil
 }
 
 func (eStorage *encodedStorage) Put(objectPath string, object io.Reader) error {
-	// split
-	chunks := make(chan split.SplitMessage)
-	go split.SplitStream(object, eStorage.BlockSize, chunks)
+	writer, err := eStorage.NewWriter(objectPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, object); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Close()
+}
+
+// NewWriter returns a streaming writer that erasure-encodes objectPath
+// incrementally as bytes arrive, rather than requiring the whole object
+// up front.
+func (eStorage *encodedStorage) NewWriter(objectPath string) (ObjectWriter, error) {
+	params, err := erasure.ParseEncoderParams(eStorage.K, eStorage.M, erasure.CAUCHY)
+	if err != nil {
+		return nil, err
+	}
+	return &objectWriter{
+		eStorage:   eStorage,
+		objectPath: objectPath,
+		encoder:    erasure.NewEncoder(params),
+		entry: StorageEntry{
+			Path:   objectPath,
+			Md5sum: "md5sum",
+			Crc:    24,
+			Blocks: make([]StorageBlockEntry, 0),
+		},
+	}, nil
+}
+
+type pipeObjectReader struct {
+	*io.PipeReader
+	closed bool
+}
+
+func (r *pipeObjectReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, ErrClosed
+	}
+	return r.PipeReader.Read(p)
+}
+
+func (r *pipeObjectReader) Close() error {
+	if r.closed {
+		return ErrClosed
+	}
+	r.closed = true
+	return r.PipeReader.Close()
+}
+
+// blockRef identifies a single shard written to a disk, so an aborted
+// objectWriter knows which shards it is responsible for rolling back.
+type blockRef struct {
+	diskIndex int
+	hash      string
+}
+
+type objectWriter struct {
+	eStorage   *encodedStorage
+	objectPath string
+	encoder    erasure.Encoder
+	entry      StorageEntry
+	index      int
+	size       int64
+	buf        []byte
+	written    []blockRef
+	// refs holds every shard this writer's chunks reference, whether it
+	// stored them itself or skipped storing because they were already
+	// deduped, so its in-flight hold on each can be released on
+	// Close/Abort.
+	refs   []blockRef
+	closed bool
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	w.buf = append(w.buf, p...)
+	for uint64(len(w.buf)) >= w.eStorage.BlockSize {
+		chunk := w.buf[:w.eStorage.BlockSize]
+		if err := w.encodeChunk(chunk); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[w.eStorage.BlockSize:]
+	}
+	return len(p), nil
+}
 
-	// for each chunk
-	encoderParameters, err := erasure.ParseEncoderParams(eStorage.K, eStorage.M, erasure.CAUCHY)
+func (w *objectWriter) encodeChunk(data []byte) error {
+	w.size += int64(len(data))
+	compressed, err := compress(w.eStorage.Compressor, data)
 	if err != nil {
 		return err
 	}
-	encoder := erasure.NewEncoder(encoderParameters)
-	entry := StorageEntry{
-		Path:   objectPath,
-		Md5sum: "md5sum",
-		Crc:    24,
-		Blocks: make([]StorageBlockEntry, 0),
-	}
-	i := 0
-	// encode
-	for chunk := range chunks {
-		if chunk.Err == nil {
-			// encode each
-			blocks, length := encoder.Encode(chunk.Data)
-			// store each
-			storeErrors := eStorage.storeBlocks(objectPath+"$"+strconv.Itoa(i), blocks)
-			for _, err := range storeErrors {
-				if err != nil {
-					return err
-				}
+	blocks, length := w.encoder.Encode(compressed)
+	hashes := hashBlocks(blocks)
+	storeErrors, newlyStored := w.eStorage.storeBlocks(hashes, blocks)
+	chunkRefs := make([]blockRef, len(newlyStored))
+	for i, stored := range newlyStored {
+		ref := blockRef{diskIndex: i, hash: hashes[i]}
+		chunkRefs[i] = ref
+		if stored {
+			w.written = append(w.written, ref)
+		}
+	}
+	w.refs = append(w.refs, chunkRefs...)
+	w.eStorage.acquireShardRefs(chunkRefs)
+	// mirror the read path's tolerance: up to M shard failures still
+	// leave the chunk reconstructible, so only give up past that.
+	if len(storeErrors) > w.eStorage.M {
+		return storeErrors[len(storeErrors)-1]
+	}
+	w.entry.Blocks = append(w.entry.Blocks, StorageBlockEntry{
+		Index:       w.index,
+		Length:      length,
+		ShardHashes: hashes,
+		Codec:       w.eStorage.Compressor.ID(),
+	})
+	w.index++
+	return nil
+}
+
+// compress runs data through compressor's Writer and returns the result.
+func compress(compressor Compressor, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := compressor.Writer(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress runs data through the Reader of the Compressor matching codec.
+func decompress(codec string, data []byte) ([]byte, error) {
+	compressor, err := compressorForCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := compressor.Reader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func (w *objectWriter) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+	if len(w.buf) > 0 {
+		if err := w.encodeChunk(w.buf); err != nil {
+			w.closed = true
+			w.eStorage.releaseShardRefs(w.refs)
+			return err
+		}
+		w.buf = nil
+	}
+	w.closed = true
+	w.entry.Size = w.size
+	w.entry.LastModified = time.Now()
+	// persistIndex puts entry into the in-memory index before it returns,
+	// even when the log append after that fails, so by the time we release
+	// our in-flight hold below, any shard this writer used is already
+	// protected by ShardReferenced.
+	err := w.eStorage.persistIndex(w.entry)
+	w.eStorage.releaseShardRefs(w.refs)
+	return err
+}
+
+// Abort rolls back any shards this writer stored that were not already
+// present on disk (deduped shards belonging to other objects are left
+// alone), and discards the in-progress manifest. Since this writer's own
+// manifest was never committed to the index, a shard it wrote is only
+// safe to delete if no other object depends on it: ShardReferenced
+// catches the case where some other manifest has already been committed
+// against the same content-addressed hash, and releasing this writer's
+// in-flight hold before checking shardInFlight catches the case where a
+// different, still-open writer dedup-matched this shard but hasn't
+// committed yet - without that second check, that writer's manifest
+// would go on to reference a shard this Abort had already deleted.
+func (w *objectWriter) Abort() error {
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	w.eStorage.releaseShardRefs(w.refs)
+	var firstErr error
+	for _, ref := range w.written {
+		w.eStorage.mu.Lock()
+		if w.eStorage.index.ShardReferenced(ref.diskIndex, ref.hash) || w.eStorage.shardInFlightLocked(ref) {
+			w.eStorage.mu.Unlock()
+			continue
+		}
+		delete(w.eStorage.blockRefs, blockRefKey(ref.diskIndex, ref.hash))
+		w.eStorage.mu.Unlock()
+		if err := deleteShard(w.eStorage.diskStorage[ref.diskIndex], blockPath(ref.hash)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// persistIndex records a finished object's manifest: it updates the
+// in-memory index and appends the manifest to the on-disk log, rather
+// than re-serializing every object on every Put. It holds eStorage.mu
+// across both steps so a concurrent Checkpoint can never snapshot the
+// index and truncate the log with this entry caught in between.
+func (eStorage *encodedStorage) persistIndex(entry StorageEntry) error {
+	eStorage.mu.Lock()
+	defer eStorage.mu.Unlock()
+	eStorage.index.Put(entry)
+	return appendLogRecord(eStorage.logFile, entry)
+}
+
+// Collect walks the shard refs this store knows about, asks the index
+// which ones are still referenced by some object's manifest, and removes
+// the ones that are not. Under dedup a shard may be referenced by
+// several objects, so deleting a shard the moment any one of its objects
+// is removed would corrupt the others; Collect is the safe place to do
+// that reclamation.
+func (eStorage *encodedStorage) Collect() error {
+	eStorage.mu.Lock()
+	refs := make([]string, 0, len(eStorage.blockRefs))
+	for ref := range eStorage.blockRefs {
+		refs = append(refs, ref)
+	}
+	eStorage.mu.Unlock()
+
+	var firstErr error
+	for _, ref := range refs {
+		diskIndex, hash, err := parseBlockRefKey(ref)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
 			}
-			blockEntry := StorageBlockEntry{
-				Index:  i,
-				Length: length,
+			continue
+		}
+		if eStorage.index.ShardReferenced(diskIndex, hash) {
+			continue
+		}
+		if err := deleteShard(eStorage.diskStorage[diskIndex], blockPath(hash)); err != nil {
+			if firstErr == nil {
+				firstErr = err
 			}
-			entry.Blocks = append(entry.Blocks, blockEntry)
+			continue
+		}
+		eStorage.mu.Lock()
+		delete(eStorage.blockRefs, ref)
+		eStorage.mu.Unlock()
+	}
+	return firstErr
+}
+
+// acquireShardRefs increments the in-flight refcount for each of refs,
+// recording that the calling writer currently depends on these shards
+// even before its manifest is committed to the index.
+func (eStorage *encodedStorage) acquireShardRefs(refs []blockRef) {
+	eStorage.mu.Lock()
+	defer eStorage.mu.Unlock()
+	for _, ref := range refs {
+		eStorage.inFlightRefs[blockRefKey(ref.diskIndex, ref.hash)]++
+	}
+}
+
+// releaseShardRefs decrements the in-flight refcount for each of refs,
+// called once a writer holding them has either committed or aborted.
+func (eStorage *encodedStorage) releaseShardRefs(refs []blockRef) {
+	eStorage.mu.Lock()
+	defer eStorage.mu.Unlock()
+	for _, ref := range refs {
+		key := blockRefKey(ref.diskIndex, ref.hash)
+		if eStorage.inFlightRefs[key] <= 1 {
+			delete(eStorage.inFlightRefs, key)
 		} else {
-			return chunk.Err
+			eStorage.inFlightRefs[key]--
 		}
-		i++
 	}
-	eStorage.objects[objectPath] = entry
-	var gobBuffer bytes.Buffer
-	gobEncoder := gob.NewEncoder(&gobBuffer)
-	gobEncoder.Encode(eStorage.objects)
-	ioutil.WriteFile(path.Join(eStorage.RootDir, "index"), gobBuffer.Bytes(), 0600)
-	return nil
 }
 
-type storeRequest struct {
-	path string
-	data []byte
+// shardInFlightLocked reports whether some other writer still holds an
+// in-flight (uncommitted) dependency on ref. Callers must hold
+// eStorage.mu.
+func (eStorage *encodedStorage) shardInFlightLocked(ref blockRef) bool {
+	return eStorage.inFlightRefs[blockRefKey(ref.diskIndex, ref.hash)] > 0
 }
 
-type storeResponse struct {
-	data []byte
-	err  error
+func (eStorage *encodedStorage) rebuildBlockRefs() {
+	for _, entry := range eStorage.index.Snapshot() {
+		for _, block := range entry.Blocks {
+			for diskIndex, hash := range block.ShardHashes {
+				eStorage.blockRefs[blockRefKey(diskIndex, hash)] = true
+			}
+		}
+	}
+}
+
+func blockRefKey(diskIndex int, hash string) string {
+	return strconv.Itoa(diskIndex) + "/" + hash
+}
+
+func parseBlockRefKey(ref string) (int, string, error) {
+	slash := -1
+	for i := 0; i < len(ref); i++ {
+		if ref[i] == '/' {
+			slash = i
+			break
+		}
+	}
+	if slash == -1 {
+		return 0, "", fmt.Errorf("malformed block ref: %s", ref)
+	}
+	diskIndex, err := strconv.Atoi(ref[:slash])
+	if err != nil {
+		return 0, "", err
+	}
+	return diskIndex, ref[slash+1:], nil
+}
+
+func blockPath(hash string) string {
+	return path.Join("block", hash)
+}
+
+// shardDeleter is implemented by disk backends capable of removing a
+// previously stored shard by path. storage.ObjectStorage itself makes no
+// such guarantee — an append-only backend, for instance, may be
+// structurally unable to delete an arbitrary prior record — so Collect
+// and Abort go through deleteShard rather than assuming every
+// diskStorage entry supports it.
+type shardDeleter interface {
+	Delete(path string) error
+}
+
+// deleteShard removes shardPath from store if its backend supports
+// per-key deletion, and reports a clear error instead of a panic or
+// silent no-op if it doesn't.
+func deleteShard(store storage.ObjectStorage, shardPath string) error {
+	deleter, ok := store.(shardDeleter)
+	if !ok {
+		return fmt.Errorf("encodedstorage: disk backend %T does not support deleting shards", store)
+	}
+	return deleter.Delete(shardPath)
+}
+
+func hashBlocks(blocks [][]byte) []string {
+	hashes := make([]string, len(blocks))
+	for i, block := range blocks {
+		sum := sha256.Sum256(block)
+		hashes[i] = hex.EncodeToString(sum[:])
+	}
+	return hashes
 }
 
 type StorageEntry struct {
-	Path   string
-	Md5sum string
-	Crc    uint32
-	Blocks []StorageBlockEntry
+	Path         string
+	Md5sum       string
+	Crc          uint32
+	Blocks       []StorageBlockEntry
+	Size         int64
+	LastModified time.Time
 }
 
+// StorageBlockEntry is the "node" manifest for a single erasure-encoded
+// chunk: the decoded length plus the content hash of each of the K+M
+// shards, indexed by disk, under the block/ keyspace. Codec records
+// which Compressor the chunk bytes were run through before erasure
+// encoding, so a chunk can still be decoded after the store's configured
+// Compressor changes.
 type StorageBlockEntry struct {
-	Index  int
-	Length int
+	Index       int
+	Length      int
+	ShardHashes []string
+	Codec       string
+}
+
+// StoreResult is the outcome of writing a single shard to disk, reported
+// by its position in diskStorage so the aggregator knows which disk
+// failed rather than just that something did.
+type StoreResult struct {
+	Index int
+	Err   error
 }
 
-func (eStorage *encodedStorage) storeBlocks(path string, blocks [][]byte) []error {
-	returnChannels := make([]<-chan error, len(eStorage.diskStorage))
+// storeBlocks writes each shard to its disk under the block/ keyspace
+// through the shared, bounded I/O pool, skipping shards that already
+// exist there. It reports, per disk index, whether a shard was newly
+// written (as opposed to deduped), so callers that need to roll back a
+// half-written object know what to undo. A shard is only marked as
+// stored once its Put has actually confirmed success; a failed Put
+// leaves blockRefs untouched so a later retry (of this object or an
+// unrelated one whose chunk hashes the same) will try storing it again
+// instead of assuming it's already on disk. It fails fast, without
+// waiting on the rest of the disks, once more than M shards have
+// errored, since at that point the object cannot be reconstructed
+// regardless.
+func (eStorage *encodedStorage) storeBlocks(hashes []string, blocks [][]byte) ([]error, []bool) {
+	newlyStored := make([]bool, len(eStorage.diskStorage))
+	results := make(chan StoreResult, len(eStorage.diskStorage))
+	pending := 0
+	eStorage.mu.Lock()
 	for i, store := range eStorage.diskStorage {
-		returnChannels[i] = storageRoutine(store, path, bytes.NewBuffer(blocks[i]))
+		ref := blockRefKey(i, hashes[i])
+		if !eStorage.Overwrite && eStorage.blockRefs[ref] {
+			// shard already stored under this hash, nothing to do
+			continue
+		}
+		pending++
+		go func(i int, store storage.ObjectStorage, shardPath string, data []byte) {
+			eStorage.ioPool.acquire()
+			defer eStorage.ioPool.release()
+			err := store.Put(shardPath, bytes.NewBuffer(data))
+			results <- StoreResult{Index: i, Err: err}
+		}(i, store, blockPath(hashes[i]), blocks[i])
 	}
+	eStorage.mu.Unlock()
 	returnErrors := make([]error, 0)
-	for _, returnChannel := range returnChannels {
-		for returnValue := range returnChannel {
-			if returnValue != nil {
-				returnErrors = append(returnErrors, returnValue)
+	for received := 0; received < pending; received++ {
+		result := <-results
+		if result.Err != nil {
+			returnErrors = append(returnErrors, result.Err)
+			if len(returnErrors) > eStorage.M {
+				// can't reconstruct this chunk regardless of how the
+				// remaining disks turn out; the stragglers still drain
+				// into the buffered channel so their goroutines exit,
+				// but any of them that go on to succeed would otherwise
+				// leave a shard on disk with no blockRefs entry, so
+				// Collect could never find it to reclaim it
+				if remaining := pending - received - 1; remaining > 0 {
+					go eStorage.drainStoreResults(results, remaining, hashes)
+				}
+				return returnErrors, newlyStored
 			}
+			continue
 		}
+		newlyStored[result.Index] = true
+		eStorage.mu.Lock()
+		eStorage.blockRefs[blockRefKey(result.Index, hashes[result.Index])] = true
+		eStorage.mu.Unlock()
+	}
+	return returnErrors, newlyStored
+}
+
+// drainStoreResults absorbs the remaining shard-store results after
+// storeBlocks has already given up on a chunk, registering any late
+// successes in blockRefs. Without this, a shard whose Put completes
+// after the early return would sit on disk permanently untracked, since
+// Collect only ever walks known blockRefs keys.
+func (eStorage *encodedStorage) drainStoreResults(results <-chan StoreResult, remaining int, hashes []string) {
+	for i := 0; i < remaining; i++ {
+		result := <-results
+		if result.Err != nil {
+			continue
+		}
+		eStorage.mu.Lock()
+		eStorage.blockRefs[blockRefKey(result.Index, hashes[result.Index])] = true
+		eStorage.mu.Unlock()
 	}
-	return returnErrors
 }
 
 func (eStorage *encodedStorage) readObject(objectPath string, entry StorageEntry, writer *io.PipeWriter) {
-	params, err := erasure.ParseEncoderParams(eStorage.K, eStorage.M, erasure.CAUCHY)
-	if err != nil {
+	params, paramsErr := erasure.ParseEncoderParams(eStorage.K, eStorage.M, erasure.CAUCHY)
+	if paramsErr != nil {
+		writer.CloseWithError(paramsErr)
+		return
 	}
 	encoder := erasure.NewEncoder(params)
-	for i, chunk := range entry.Blocks {
-		blockSlices := eStorage.getBlockSlices(objectPath + "$" + strconv.Itoa(i))
-		var blocks [][]byte
-		for _, slice := range blockSlices {
-			if slice.err != nil {
-				writer.CloseWithError(err)
-				return
-			}
-			blocks = append(blocks, slice.data)
+	for _, chunk := range entry.Blocks {
+		blocks, err := eStorage.getBlockSlices(chunk.ShardHashes)
+		if err != nil {
+			writer.CloseWithError(err)
+			return
 		}
-		data, err := encoder.Decode(blocks, chunk.Length)
+		encoded, err := encoder.Decode(blocks, chunk.Length)
+		if err != nil {
+			writer.CloseWithError(err)
+			return
+		}
+		data, err := decompress(chunk.Codec, encoded)
 		if err != nil {
 			writer.CloseWithError(err)
 			return
@@ -185,6 +718,7 @@ func (eStorage *encodedStorage) readObject(objectPath string, entry StorageEntry
 			written, err := writer.Write(data[bytesWritten:len(data)])
 			if err != nil {
 				writer.CloseWithError(err)
+				return
 			}
 			bytesWritten += written
 		}
@@ -192,41 +726,60 @@ func (eStorage *encodedStorage) readObject(objectPath string, entry StorageEntry
 	writer.Close()
 }
 
-func (eStorage *encodedStorage) getBlockSlices(objectPath string) []storeResponse {
-	responses := make([]<-chan storeResponse, 0)
-	for i := 0; i < len(eStorage.diskStorage); i++ {
-		response := getSlice(eStorage.diskStorage[i], objectPath)
-		responses = append(responses, response)
-	}
-	results := make([]storeResponse, 0)
-	for _, response := range responses {
-		results = append(results, <-response)
-	}
-	return results
+type shardResult struct {
+	index int
+	data  []byte
+	err   error
 }
 
-func getSlice(store storage.ObjectStorage, path string) <-chan storeResponse {
-	out := make(chan storeResponse)
-	go func() {
-		obj, err := store.Get(path)
-		if err != nil {
-			out <- storeResponse{data: nil, err: err}
-		} else {
+// getBlockSlices fetches a chunk's shards through the shared, bounded
+// I/O pool and returns as soon as K of them have arrived successfully,
+// which is all erasure.Decode needs. The remaining fetches are signalled
+// to stop via ctx rather than being waited on, so one slow or dead disk
+// can no longer add its full latency to every read.
+func (eStorage *encodedStorage) getBlockSlices(hashes []string) ([][]byte, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan shardResult, len(hashes))
+	for i, hash := range hashes {
+		go func(i int, hash string) {
+			eStorage.ioPool.acquire()
+			defer eStorage.ioPool.release()
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			obj, err := eStorage.diskStorage[i].Get(blockPath(hash))
+			if err != nil {
+				results <- shardResult{index: i, err: err}
+				return
+			}
 			data, err := ioutil.ReadAll(obj)
-			out <- storeResponse{data: data, err: err}
-		}
-		close(out)
-	}()
-	return out
-}
+			results <- shardResult{index: i, data: data, err: err}
+		}(i, hash)
+	}
 
-func storageRoutine(store storage.ObjectStorage, path string, data io.Reader) <-chan error {
-	out := make(chan error)
-	go func() {
-		if err := store.Put(path, data); err != nil {
-			out <- err
+	blocks := make([][]byte, len(hashes))
+	successes := 0
+	errCount := 0
+	var lastErr error
+	for received := 0; received < len(hashes); received++ {
+		result := <-results
+		if result.err != nil {
+			errCount++
+			lastErr = result.err
+			if errCount > eStorage.M {
+				return nil, lastErr
+			}
+			continue
 		}
-		close(out)
-	}()
-	return out
+		blocks[result.index] = result.data
+		successes++
+		if successes >= eStorage.K {
+			return blocks, nil
+		}
+	}
+	return nil, lastErr
 }
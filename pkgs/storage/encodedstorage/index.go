@@ -0,0 +1,316 @@
+package encodedstorage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+const (
+	indexPackName = "index.pack"
+	indexLogName  = "index.log"
+)
+
+// shardLocation points back from a shard hash to the object/chunk/shard
+// position that references it, so Collect can tell whether a block shard
+// is still in use without re-walking every manifest in the index.
+type shardLocation struct {
+	ObjectPath string
+	Chunk      int
+	Shard      int
+}
+
+// MemoryIndex is the in-memory view of the object index: the object path
+// -> StorageEntry map used to serve Get/Put, a sorted slice of object
+// paths used to serve List by prefix in O(results), and a secondary map
+// from shard hash to the locations that reference it, used by the dedup
+// refcount sweep.
+type MemoryIndex struct {
+	// mu guards objects, shards and paths below, which Put/Get/
+	// PathsWithPrefix/ShardReferenced/Snapshot may all touch from
+	// whatever goroutine is serving the current request.
+	mu      sync.RWMutex
+	objects map[string]StorageEntry
+	shards  map[string][]shardLocation
+	paths   []string
+}
+
+func newMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{
+		objects: make(map[string]StorageEntry),
+		shards:  make(map[string][]shardLocation),
+	}
+}
+
+func (idx *MemoryIndex) Get(objectPath string) (StorageEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	entry, ok := idx.objects[objectPath]
+	return entry, ok
+}
+
+// Put inserts or replaces an object's manifest, indexes its shard hashes
+// for the dedup sweep, and keeps the sorted path catalog used by List
+// up to date. If entry.Path was already indexed, the previous manifest's
+// shard locations are removed first, so an overwritten object's old
+// shards stop looking referenced and Collect can reclaim them.
+func (idx *MemoryIndex) Put(entry StorageEntry) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if previous, exists := idx.objects[entry.Path]; exists {
+		idx.removeShardLocationsLocked(previous)
+	} else {
+		idx.insertPath(entry.Path)
+	}
+	idx.objects[entry.Path] = entry
+	for chunkIndex, block := range entry.Blocks {
+		for shardIndex, hash := range block.ShardHashes {
+			idx.shards[hash] = append(idx.shards[hash], shardLocation{
+				ObjectPath: entry.Path,
+				Chunk:      chunkIndex,
+				Shard:      shardIndex,
+			})
+		}
+	}
+}
+
+// removeShardLocationsLocked strips every shardLocation belonging to
+// entry out of idx.shards. Callers must hold idx.mu.
+func (idx *MemoryIndex) removeShardLocationsLocked(entry StorageEntry) {
+	for _, block := range entry.Blocks {
+		for _, hash := range block.ShardHashes {
+			locs := idx.shards[hash]
+			kept := locs[:0]
+			for _, loc := range locs {
+				if loc.ObjectPath != entry.Path {
+					kept = append(kept, loc)
+				}
+			}
+			if len(kept) == 0 {
+				delete(idx.shards, hash)
+			} else {
+				idx.shards[hash] = kept
+			}
+		}
+	}
+}
+
+func (idx *MemoryIndex) insertPath(objectPath string) {
+	i := sort.SearchStrings(idx.paths, objectPath)
+	idx.paths = append(idx.paths, "")
+	copy(idx.paths[i+1:], idx.paths[i:])
+	idx.paths[i] = objectPath
+}
+
+// PathsWithPrefix returns the sorted object paths starting with prefix,
+// restricted to those sorting strictly after marker (if marker is set).
+// Both bounds are located with a binary search, so the cost of finding
+// the run is O(log n); maxKeys (0 meaning unlimited) then bounds how far
+// into that run the scan walks, so a small page against a huge prefix
+// run costs O(maxKeys) rather than O(len(run)). truncated reports
+// whether more matching paths exist past the ones returned.
+func (idx *MemoryIndex) PathsWithPrefix(prefix, marker string, maxKeys int) (matches []string, truncated bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	lo := sort.SearchStrings(idx.paths, prefix)
+	if marker != "" {
+		markerIndex := sort.SearchStrings(idx.paths, marker)
+		for markerIndex < len(idx.paths) && idx.paths[markerIndex] == marker {
+			markerIndex++
+		}
+		if markerIndex > lo {
+			lo = markerIndex
+		}
+	}
+	for i := lo; i < len(idx.paths); i++ {
+		if len(idx.paths[i]) < len(prefix) || idx.paths[i][:len(prefix)] != prefix {
+			break
+		}
+		if maxKeys > 0 && len(matches) >= maxKeys {
+			truncated = true
+			break
+		}
+		matches = append(matches, idx.paths[i])
+	}
+	return matches, truncated
+}
+
+// ShardReferenced reports whether any known manifest still references the
+// shard at disk index shardIndex under hash.
+func (idx *MemoryIndex) ShardReferenced(shardIndex int, hash string) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	for _, loc := range idx.shards[hash] {
+		if loc.Shard == shardIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshot returns a copy of the current object map, suitable for
+// encoding into an index.pack file.
+func (idx *MemoryIndex) Snapshot() map[string]StorageEntry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	snapshot := make(map[string]StorageEntry, len(idx.objects))
+	for objectPath, entry := range idx.objects {
+		snapshot[objectPath] = entry
+	}
+	return snapshot
+}
+
+// loadIndex builds a MemoryIndex from index.pack (if present) and replays
+// any StorageEntry records appended to index.log since that snapshot was
+// taken. It returns the index plus the log file, left open and positioned
+// at the end for further appends.
+func loadIndex(rootDir string) (*MemoryIndex, *os.File, error) {
+	idx := newMemoryIndex()
+
+	packPath := path.Join(rootDir, indexPackName)
+	if packFile, err := os.Open(packPath); err == nil {
+		snapshot := make(map[string]StorageEntry)
+		err := gob.NewDecoder(packFile).Decode(&snapshot)
+		packFile.Close()
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		for _, entry := range snapshot {
+			idx.Put(entry)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	logPath := path.Join(rootDir, indexLogName)
+	if logFile, err := os.Open(logPath); err == nil {
+		entries, err := readLogRecords(logFile)
+		logFile.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			idx.Put(entry)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return idx, logFile, nil
+}
+
+// appendLogRecord writes a single length-prefixed, CRC32-checked
+// StorageEntry record to the index log and fsyncs it, so a Put is durable
+// without re-serializing the whole index.
+func appendLogRecord(logFile *os.File, entry StorageEntry) error {
+	var payloadBuf bytes.Buffer
+	if err := gob.NewEncoder(&payloadBuf).Encode(entry); err != nil {
+		return err
+	}
+	payload := payloadBuf.Bytes()
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+	if _, err := logFile.Write(header); err != nil {
+		return err
+	}
+	if _, err := logFile.Write(payload); err != nil {
+		return err
+	}
+	return logFile.Sync()
+}
+
+// readLogRecords replays every well-formed record in the log. A record
+// whose length or payload is truncated, or whose CRC32 doesn't match, can
+// only be a torn tail write from a process that died mid-append; replay
+// stops there rather than erroring, discarding that last partial record.
+func readLogRecords(r io.Reader) ([]StorageEntry, error) {
+	var entries []StorageEntry
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+
+		var entry StorageEntry
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entry); err != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Checkpoint folds the index log into a fresh index.pack snapshot and
+// truncates the log. The pack is replaced atomically via rename, so a
+// crash mid-checkpoint never leaves a half-written pack; a crash after
+// the rename but before the truncate leaves the new pack beside the old
+// log, whose records the new pack already holds. It holds eStorage.mu for the whole snapshot ->
+// rename -> truncate sequence, the same lock persistIndex holds while
+// appending, so a Put can never land in the log file between the
+// moment it's snapshotted and the moment it's truncated to empty -
+// otherwise that Put's record would exist in neither the new pack nor
+// the log and would silently vanish.
+func (eStorage *encodedStorage) Checkpoint() error {
+	eStorage.mu.Lock()
+	defer eStorage.mu.Unlock()
+
+	tmpPath := path.Join(eStorage.RootDir, indexPackName+".tmp")
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(tmpFile).Encode(eStorage.index.Snapshot()); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path.Join(eStorage.RootDir, indexPackName)); err != nil {
+		return err
+	}
+	return eStorage.resetLogLocked()
+}
+
+// resetLogLocked replaces the current log file handle with a freshly
+// truncated one, called once the log's contents have been folded into a
+// pack. Callers must hold eStorage.mu.
+func (eStorage *encodedStorage) resetLogLocked() error {
+	logFile, err := os.OpenFile(path.Join(eStorage.RootDir, indexLogName), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	oldLogFile := eStorage.logFile
+	eStorage.logFile = logFile
+	if oldLogFile != nil {
+		oldLogFile.Close()
+	}
+	return nil
+}